@@ -0,0 +1,79 @@
+// Package logging provides the process-wide structured logger used in
+// place of logrus. It wraps a lock-free diode writer so that hot paths
+// (ClickHouse.Add, the proxy handlers) never block on log I/O, and
+// exposes a thin adapter that mirrors the logrus `WithError(err).Warn(...)`
+// call sites so existing callers didn't need to change shape.
+package logging
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/diode"
+)
+
+const (
+	LOG_FORMAT = "log-format"
+)
+
+// Log is the process-wide logger. Init replaces it with a diode-backed
+// writer once the --log-format flag has been parsed; until then it writes
+// synchronously so that early startup logs are never lost.
+var Log = zerolog.New(os.Stderr).With().Timestamp().Logger()
+
+var droppedMessages uint64
+
+// Init configures Log for the given format ("json" or "text") and wraps
+// its output in a non-blocking diode writer.
+func Init(format string) {
+	out := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	if format == "json" {
+		Log = zerolog.New(diode.NewWriter(os.Stdout, 4096, 10*time.Millisecond, onDropped)).With().Timestamp().Logger()
+		return
+	}
+	Log = zerolog.New(diode.NewWriter(out, 4096, 10*time.Millisecond, onDropped)).With().Timestamp().Logger()
+}
+
+func onDropped(missed int) {
+	atomic.AddUint64(&droppedMessages, uint64(missed))
+}
+
+// DroppedMessages reports how many log lines the diode writer has had to
+// drop because a consumer fell behind. This package has no metrics
+// registration of its own; callers that expose one can poll this to
+// publish a dropped_log_messages_total gauge.
+func DroppedMessages() uint64 {
+	return atomic.LoadUint64(&droppedMessages)
+}
+
+// Entry mirrors logrus' WithError(err) chaining so the diff at call sites
+// stays minimal.
+type Entry struct {
+	err error
+}
+
+func WithError(err error) *Entry {
+	return &Entry{err: err}
+}
+
+func (e *Entry) Info(msg string) {
+	Log.Info().Err(e.err).Msg(msg)
+}
+
+func (e *Entry) Warn(msg string) {
+	Log.Warn().Err(e.err).Msg(msg)
+}
+
+func (e *Entry) Error(msg string) {
+	Log.Error().Err(e.err).Msg(msg)
+}
+
+func (e *Entry) Fatal(msg string) {
+	Log.Fatal().Err(e.err).Msg(msg)
+}
+
+func Infof(format string, args ...interface{}) {
+	Log.Info().Msgf(format, args...)
+}
@@ -3,19 +3,26 @@ package main
 import (
 	"os"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+
+	log "github.com/iOS-web-tools/torrent-http-proxy/logging"
 )
 
 func main() {
-	// log.SetFormatter(joonix.NewFormatter())
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp: true,
-	})
 	app := cli.NewApp()
 	app.Name = "torrent-http-proxy"
 	app.Usage = "Proxies all the things"
 	app.Version = "0.0.1"
+	app.Flags = append(app.Flags, cli.StringFlag{
+		Name:   log.LOG_FORMAT,
+		Usage:  "log output format (text or json)",
+		Value:  "text",
+		EnvVar: "LOG_FORMAT",
+	})
+	app.Before = func(c *cli.Context) error {
+		log.Init(c.String(log.LOG_FORMAT))
+		return nil
+	}
 	configure(app)
 	err := app.Run(os.Args)
 	if err != nil {
@@ -1,21 +1,32 @@
 package services
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	log "github.com/iOS-web-tools/torrent-http-proxy/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/urfave/cli"
 )
 
 const (
-	CLICKHOUSE_BATCH_SIZE = "clickhouse-batch-size"
-	CLICKHOUSE_REPLICATED = "clickhouse-replicated"
+	CLICKHOUSE_BATCH_SIZE           = "clickhouse-batch-size"
+	CLICKHOUSE_REPLICATED           = "clickhouse-replicated"
+	CLICKHOUSE_ASYNC_INSERT         = "clickhouse-async-insert"
+	CLICKHOUSE_MAX_ROWS_PER_INSERT  = "clickhouse-max-rows-per-insert"
+	CLICKHOUSE_FLUSH_INTERVAL       = "clickhouse-flush-interval"
+	CLICKHOUSE_COMPRESSION          = "clickhouse-compression"
+	CLICKHOUSE_WORKERS              = "clickhouse-workers"
+	CLICKHOUSE_MAX_IN_FLIGHT        = "clickhouse-max-in-flight"
+	CLICKHOUSE_DROP_ON_BACKPRESSURE = "clickhouse-drop-on-backpressure"
 )
 
 func RegisterClickHouseFlags(c *cli.App) {
@@ -30,17 +41,81 @@ func RegisterClickHouseFlags(c *cli.App) {
 		Usage:  "clickhouse replication enabled",
 		EnvVar: "CLICKHOUSE_REPLICATED",
 	})
+	c.Flags = append(c.Flags, cli.BoolFlag{
+		Name:   CLICKHOUSE_ASYNC_INSERT,
+		Usage:  "use ClickHouse async inserts instead of waiting for each batch to land",
+		EnvVar: "CLICKHOUSE_ASYNC_INSERT",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   CLICKHOUSE_MAX_ROWS_PER_INSERT,
+		Usage:  "maximum number of rows sent in a single INSERT statement",
+		Value:  1000,
+		EnvVar: "CLICKHOUSE_MAX_ROWS_PER_INSERT",
+	})
+	c.Flags = append(c.Flags, cli.DurationFlag{
+		Name:   CLICKHOUSE_FLUSH_INTERVAL,
+		Usage:  "maximum time a non-empty batch is held before being flushed to ClickHouse",
+		Value:  5 * time.Second,
+		EnvVar: "CLICKHOUSE_FLUSH_INTERVAL",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   CLICKHOUSE_COMPRESSION,
+		Usage:  "compression used for the ClickHouse connection (lz4, zstd or none)",
+		Value:  "lz4",
+		EnvVar: "CLICKHOUSE_COMPRESSION",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   CLICKHOUSE_WORKERS,
+		Usage:  "number of workers storing batches to ClickHouse concurrently",
+		Value:  2,
+		EnvVar: "CLICKHOUSE_WORKERS",
+	})
+	c.Flags = append(c.Flags, cli.IntFlag{
+		Name:   CLICKHOUSE_MAX_IN_FLIGHT,
+		Usage:  "number of full batches allowed to queue for storing before backpressure kicks in",
+		Value:  16,
+		EnvVar: "CLICKHOUSE_MAX_IN_FLIGHT",
+	})
+	c.Flags = append(c.Flags, cli.BoolFlag{
+		Name:   CLICKHOUSE_DROP_ON_BACKPRESSURE,
+		Usage:  "drop batches instead of blocking Add when the in-flight queue is full",
+		EnvVar: "CLICKHOUSE_DROP_ON_BACKPRESSURE",
+	})
+}
+
+// DBProvider resolves the native ClickHouse connection used for stat
+// ingestion. Implementations are free to lazily dial and reuse a single
+// clickhouse.Conn across calls.
+//
+// Get's signature changed from Get() (*sql.DB, error) to
+// Get(ctx) (clickhouse.Conn, error) when this package moved off database/sql
+// onto the clickhouse-go/v2 native driver; there is no compatibility shim,
+// so any other DBProvider implementation in the wider repo needs to be
+// updated to match before it will compile against this package again.
+type DBProvider interface {
+	Get(ctx context.Context) (clickhouse.Conn, error)
 }
 
 type ClickHouse struct {
-	db         DBProvider
-	batchSize  int
-	batch      []*StatRecord
-	mux        sync.Mutex
-	storeMux   sync.Mutex
-	init       sync.Once
-	nodeName   string
-	replicated bool
+	db                 DBProvider
+	batchSize          int
+	batch              []*StatRecord
+	mux                sync.Mutex
+	init               sync.Once
+	nodeName           string
+	replicated         bool
+	asyncInsert        bool
+	maxRowsPerInsert   int
+	compression        string
+	flushInterval      time.Duration
+	stop               chan struct{}
+	stopped            sync.WaitGroup
+	batches            chan []*StatRecord
+	workers            sync.WaitGroup
+	dropOnBackpressure bool
+	droppedRecords     uint64
+	closeMux           sync.RWMutex
+	closed             bool
 }
 
 type StatRecord struct {
@@ -64,17 +139,117 @@ type StatRecord struct {
 }
 
 func NewClickHouse(c *cli.Context, db DBProvider) *ClickHouse {
+	workers := c.Int(CLICKHOUSE_WORKERS)
+	if workers <= 0 {
+		workers = 1
+	}
+	s := &ClickHouse{
+		db:                 db,
+		batchSize:          c.Int(CLICKHOUSE_BATCH_SIZE),
+		batch:              make([]*StatRecord, 0, c.Int(CLICKHOUSE_BATCH_SIZE)),
+		nodeName:           c.String(MY_NODE_NAME),
+		replicated:         c.Bool(CLICKHOUSE_REPLICATED),
+		asyncInsert:        c.Bool(CLICKHOUSE_ASYNC_INSERT),
+		maxRowsPerInsert:   c.Int(CLICKHOUSE_MAX_ROWS_PER_INSERT),
+		compression:        c.String(CLICKHOUSE_COMPRESSION),
+		flushInterval:      c.Duration(CLICKHOUSE_FLUSH_INTERVAL),
+		stop:               make(chan struct{}),
+		batches:            make(chan []*StatRecord, c.Int(CLICKHOUSE_MAX_IN_FLIGHT)),
+		dropOnBackpressure: c.Bool(CLICKHOUSE_DROP_ON_BACKPRESSURE),
+	}
+	for i := 0; i < workers; i++ {
+		s.workers.Add(1)
+		go s.storeWorker()
+	}
+	s.stopped.Add(1)
+	go s.flushLoop()
+	return s
+}
+
+// Compression reports the configured connection compression so that
+// whatever constructs the underlying clickhouse.Conn can apply it.
+func (s *ClickHouse) Compression() string {
+	return s.compression
+}
+
+// DroppedRecords reports how many records were dropped, either because the
+// in-flight queue was full and CLICKHOUSE_DROP_ON_BACKPRESSURE is set, or
+// because a full batch was enqueued after Close. Callers that expose a metrics endpoint can poll this to publish a
+// dropped_records_total gauge; this package has no metrics registration of
+// its own.
+func (s *ClickHouse) DroppedRecords() uint64 {
+	return atomic.LoadUint64(&s.droppedRecords)
+}
+
+func (s *ClickHouse) storeWorker() {
+	defer s.workers.Done()
+	for b := range s.batches {
+		if err := s.store(context.Background(), b); err != nil {
+			log.WithError(err).Warn("Failed to store to ClickHouse")
+		}
+	}
+}
+
+// swapBatch atomically captures the current batch and resets it, so that
+// concurrent Add calls can never observe a partially-reset batch.
+func (s *ClickHouse) swapBatch() []*StatRecord {
+	s.mux.Lock()
+	b := s.batch
+	s.batch = make([]*StatRecord, 0, s.batchSize)
+	s.mux.Unlock()
+	return b
+}
+
+// enqueue hands a full batch to the worker pool, applying backpressure
+// (block or drop, per CLICKHOUSE_DROP_ON_BACKPRESSURE) when it's full.
+// closeMux's read lock is held for the duration of the send so that Close
+// can never close s.batches out from under an in-flight send: Close takes
+// the write lock before closing the channel, which blocks until every
+// enqueue holding the read lock has returned.
+func (s *ClickHouse) enqueue(b []*StatRecord) {
+	if len(b) == 0 {
+		return
+	}
+	s.closeMux.RLock()
+	defer s.closeMux.RUnlock()
+	if s.closed {
+		atomic.AddUint64(&s.droppedRecords, uint64(len(b)))
+		log.WithError(errors.Errorf("enqueue after Close, dropped %v records", len(b))).Warn("Dropping ClickHouse batch")
+		return
+	}
+	if !s.dropOnBackpressure {
+		s.batches <- b
+		return
+	}
+	select {
+	case s.batches <- b:
+	default:
+		atomic.AddUint64(&s.droppedRecords, uint64(len(b)))
+		log.WithError(errors.Errorf("in-flight queue full, dropped %v records", len(b))).Warn("Dropping ClickHouse batch")
+	}
+}
 
-	return &ClickHouse{
-		db:         db,
-		batchSize:  c.Int(CLICKHOUSE_BATCH_SIZE),
-		batch:      make([]*StatRecord, 0, c.Int(CLICKHOUSE_BATCH_SIZE)),
-		nodeName:   c.String(MY_NODE_NAME),
-		replicated: c.Bool(CLICKHOUSE_REPLICATED),
+// flushLoop periodically flushes a non-empty batch so that low-traffic
+// deployments don't hold records in memory until batchSize is reached.
+func (s *ClickHouse) flushLoop() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			return
+		}
 	}
 }
 
-func (s *ClickHouse) makeTable(db *sql.DB) error {
+func (s *ClickHouse) flush() {
+	s.enqueue(s.swapBatch())
+}
+
+func (s *ClickHouse) makeTable(ctx context.Context, conn clickhouse.Conn) error {
 	table := "proxy_stat"
 	tableExpr := table
 	engine := "MergeTree()"
@@ -83,7 +258,7 @@ func (s *ClickHouse) makeTable(db *sql.DB) error {
 		tableExpr += " on cluster '{cluster}'"
 		engine = "ReplicatedMergeTree('/clickhouse/{installation}/{cluster}/tables/{shard}/{database}/{table}', '{replica}')"
 	}
-	_, err := db.Exec(fmt.Sprintf(strings.TrimSpace(`
+	err := conn.Exec(ctx, fmt.Sprintf(strings.TrimSpace(`
 		CREATE TABLE IF NOT EXISTS %v (
 			timestamp      DateTime,
 			api_key        String,
@@ -112,7 +287,7 @@ func (s *ClickHouse) makeTable(db *sql.DB) error {
 		return err
 	}
 	if s.replicated {
-		_, err = db.Exec(fmt.Sprintf(strings.TrimSpace(`
+		err = conn.Exec(ctx, fmt.Sprintf(strings.TrimSpace(`
 			CREATE TABLE IF NOT EXISTS %v_all on cluster '{cluster}' as %v
 			ENGINE = Distributed('{cluster}', default, %v, rand())
 		`), table, table, table))
@@ -120,86 +295,132 @@ func (s *ClickHouse) makeTable(db *sql.DB) error {
 	return err
 }
 
-func (s *ClickHouse) store(sr []*StatRecord) error {
-	s.storeMux.Lock()
+// withInsertSettings threads the async insert SETTINGS onto ctx so they
+// apply to the PrepareBatch/Send calls that follow.
+func (s *ClickHouse) withInsertSettings(ctx context.Context) context.Context {
+	if !s.asyncInsert {
+		return ctx
+	}
+	return clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"async_insert":          1,
+		"wait_for_async_insert": 0,
+	}))
+}
+
+func (s *ClickHouse) store(ctx context.Context, sr []*StatRecord) error {
 	if len(sr) == 0 {
 		return nil
 	}
-	logrus.Infof("Storing %v rows to ClickHouse", len(sr))
-	defer func() {
-		logrus.Infof("Finish storing %v rows to ClickHouse", len(sr))
-		s.storeMux.Unlock()
-	}()
-	db, err := s.db.Get()
+	log.Infof("Storing %v rows to ClickHouse", len(sr))
+	defer log.Infof("Finish storing %v rows to ClickHouse", len(sr))
+
+	chunkSize := s.maxRowsPerInsert
+	if chunkSize <= 0 || chunkSize > len(sr) {
+		chunkSize = len(sr)
+	}
+	for i := 0; i < len(sr); i += chunkSize {
+		end := i + chunkSize
+		if end > len(sr) {
+			end = len(sr)
+		}
+		if err := s.storeChunk(ctx, sr[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ClickHouse) storeChunk(ctx context.Context, sr []*StatRecord) error {
+	ctx, span := otel.Tracer("clickhouse").Start(ctx, "clickhouse.insert")
+	defer span.End()
+
+	table := "proxy_stat"
+	if s.replicated {
+		table += "_all"
+	}
+
+	conn, err := s.db.Get(ctx)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to get ClickHouse DB")
+		span.RecordError(err)
+		return errors.Wrapf(err, "Failed to get ClickHouse connection")
 	}
+	var initErr error
 	s.init.Do(func() {
-		err = s.makeTable(db)
+		initErr = s.makeTable(ctx, conn)
 	})
-	if err != nil {
-		return errors.Wrapf(err, "Failed to create table")
+	if initErr != nil {
+		span.RecordError(initErr)
+		return errors.Wrapf(initErr, "Failed to create table")
 	}
-	err = db.Ping()
-	if err != nil {
+	if err := conn.Ping(ctx); err != nil {
+		span.RecordError(err)
 		return errors.Wrapf(err, "Failed to ping")
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrapf(err, "Failed to begin")
-	}
-	table := "proxy_stat"
-	if s.replicated {
-		table += "_all"
-	}
-	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %v (timestamp, api_key, client, bytes_written, ttfb,
-		duration, path, infohash, original_path, session_id, domain, status, grouped_status, edge,
-		source, role, ads, node) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, table))
+
+	query := fmt.Sprintf("INSERT INTO %v (timestamp, api_key, client, bytes_written, ttfb, duration, "+
+		"path, infohash, original_path, session_id, domain, status, grouped_status, edge, source, role, ads, node)", table)
+	span.SetAttributes(
+		attribute.String("db.statement", query),
+		attribute.Int("db.rows", len(sr)),
+	)
+
+	batch, err := conn.PrepareBatch(s.withInsertSettings(ctx), query)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to prepare")
+		span.RecordError(err)
+		return errors.Wrapf(err, "Failed to prepare batch")
 	}
-	defer stmt.Close()
 	for _, r := range sr {
 		var adsUInt uint8
 		if r.Ads {
 			adsUInt = 1
 		}
-		_, err = stmt.Exec(
+		err = batch.Append(
 			r.Timestamp, r.ApiKey, r.Client, r.BytesWritten, r.TTFB,
 			r.Duration, r.Path, r.InfoHash, r.OriginalPath, r.SessionID,
 			r.Domain, r.Status, r.GroupedStatus, r.Edge, r.Source,
 			r.Role, adsUInt, s.nodeName,
 		)
 		if err != nil {
-			return errors.Wrapf(err, "Failed to exec")
+			span.RecordError(err)
+			return errors.Wrapf(err, "Failed to append row")
 		}
 	}
-	err = tx.Commit()
-	if err != nil {
-		return errors.Wrapf(err, "Failed to commit")
+	if err := batch.Send(); err != nil {
+		span.RecordError(err)
+		return errors.Wrapf(err, "Failed to send batch")
 	}
 	return nil
 }
 
+// Add implements StatSink. It batches sr and, once the batch crosses
+// batchSize, hands it off to the worker pool via a bounded channel. The
+// swap of s.batch happens atomically under s.mux (see swapBatch), so
+// concurrent Add calls can never observe a partially-reset batch.
 func (s *ClickHouse) Add(sr *StatRecord) error {
 	s.mux.Lock()
 	s.batch = append(s.batch, sr)
+	full := len(s.batch) >= s.batchSize
 	s.mux.Unlock()
-	if len(s.batch) >= s.batchSize {
-		go func(b []*StatRecord) {
-			err := s.store(b)
-			if err != nil {
-				logrus.WithError(err).Warn("Failed to store to ClickHouse")
-			}
-		}(s.batch)
-		s.mux.Lock()
-		s.batch = make([]*StatRecord, 0, s.batchSize)
-		s.mux.Unlock()
+	if full {
+		s.enqueue(s.swapBatch())
 	}
 	return nil
 }
 
-func (s *ClickHouse) Close() {
-	s.store(s.batch)
-	s.batch = []*StatRecord{}
+// Close implements StatSink. It stops the flush loop, stops accepting new
+// batches, waits for the worker pool to drain the queue, then stores
+// whatever remains in the current batch directly. Taking closeMux's write
+// lock before closing s.batches ensures no concurrent Add/enqueue call is
+// still sending on it - see enqueue.
+func (s *ClickHouse) Close() error {
+	close(s.stop)
+	s.stopped.Wait()
+
+	s.closeMux.Lock()
+	s.closed = true
+	close(s.batches)
+	s.closeMux.Unlock()
+
+	s.workers.Wait()
+	return s.store(context.Background(), s.swapBatch())
 }
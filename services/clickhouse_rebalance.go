@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+
+	log "github.com/iOS-web-tools/torrent-http-proxy/logging"
+)
+
+// ShardDBProvider is implemented by a DBProvider that can also dial a
+// specific shard directly, identified by the shard number system.parts
+// reports it under. Rebalance needs this because ALTER TABLE ... MOVE
+// PARTITION ... TO SHARD must run on the node that physically owns the
+// source partition, not on whatever node the pooled connection happens to
+// route to.
+type ShardDBProvider interface {
+	GetShard(ctx context.Context, shard string) (clickhouse.Conn, error)
+}
+
+// shardPartition is one (shard, partition) pair reported by system.parts
+// across the cluster, with its current row count. Because proxy_stat's
+// Distributed engine shards with rand(), a single partition's rows are
+// normally spread across every shard, so each (shard, partition) pair is
+// an independently movable unit.
+type shardPartition struct {
+	Shard     string
+	Partition string
+	Rows      uint64
+}
+
+// partitionMove describes one (shard, partition) pair that needs to move
+// to a different shard to reach the target shard count.
+type partitionMove struct {
+	Partition string
+	FromShard string
+	ToShard   string
+}
+
+// Rebalance moves proxy_stat partitions onto targetShardCount shards using
+// ALTER TABLE ... MOVE PARTITION rather than the INSERT SELECT FROM
+// cluster(...) approach, which would double-store data and require
+// downtime. It verifies the total row count before and after and aborts
+// with an error if the counts diverge.
+func (s *ClickHouse) Rebalance(ctx context.Context, targetShardCount int, concurrency int) error {
+	shardDB, ok := s.db.(ShardDBProvider)
+	if !ok {
+		return errors.New("DBProvider does not implement ShardDBProvider, cannot dial individual shards for MOVE PARTITION")
+	}
+
+	conn, err := s.db.Get(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get ClickHouse connection")
+	}
+
+	before, err := s.totalRows(ctx, conn)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to count rows before rebalance")
+	}
+
+	parts, err := s.shardPartitions(ctx, conn)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to enumerate shard partitions")
+	}
+
+	moves := planRebalance(parts, targetShardCount)
+	if len(moves) == 0 {
+		log.Infof("No partitions need to move for a %v-shard target", targetShardCount)
+		return nil
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	errs := make(chan error, len(moves))
+	var wg sync.WaitGroup
+	for _, m := range moves {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(m partitionMove) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs <- s.movePartition(ctx, shardDB, m)
+		}(m)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return errors.Wrapf(err, "Failed to move partition")
+		}
+	}
+
+	after, err := s.totalRows(ctx, conn)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to count rows after rebalance")
+	}
+	if before != after {
+		return errors.Errorf("row count diverged after rebalance: before=%v after=%v", before, after)
+	}
+	log.Infof("Rebalanced %v partitions onto %v shards", len(moves), targetShardCount)
+	return nil
+}
+
+func (s *ClickHouse) totalRows(ctx context.Context, conn clickhouse.Conn) (uint64, error) {
+	var count uint64
+	err := conn.QueryRow(ctx, "SELECT count() FROM cluster('{cluster}', default.proxy_stat)").Scan(&count)
+	return count, err
+}
+
+func (s *ClickHouse) shardPartitions(ctx context.Context, conn clickhouse.Conn) ([]shardPartition, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT _shard_num, partition, sum(rows) AS rows
+		FROM clusterAllReplicas('{cluster}', system.parts)
+		WHERE table = 'proxy_stat' AND active
+		GROUP BY _shard_num, partition
+		ORDER BY partition
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []shardPartition
+	for rows.Next() {
+		var p shardPartition
+		var shardNum uint32
+		if err := rows.Scan(&shardNum, &p.Partition, &p.Rows); err != nil {
+			return nil, err
+		}
+		p.Shard = fmt.Sprintf("%v", shardNum)
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+// planRebalance assigns each (shard, partition) pair in parts to one of
+// targetShardCount shards, greedily placing the heaviest pairs first onto
+// whichever target shard currently holds the fewest rows. Each pair is
+// planned independently, since a partition's rows are normally already
+// spread across every shard - collapsing them into one move per partition
+// would silently drop the moves needed for every shard but the first one
+// seen.
+func planRebalance(parts []shardPartition, targetShardCount int) []partitionMove {
+	ordered := make([]shardPartition, len(parts))
+	copy(ordered, parts)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Rows > ordered[j].Rows })
+
+	targetShards := make([]string, targetShardCount)
+	load := make([]uint64, targetShardCount)
+	for i := range targetShards {
+		targetShards[i] = fmt.Sprintf("%v", i+1)
+	}
+
+	var moves []partitionMove
+	for _, p := range ordered {
+		lightest := 0
+		for i := range load {
+			if load[i] < load[lightest] {
+				lightest = i
+			}
+		}
+		load[lightest] += p.Rows
+		if targetShards[lightest] != p.Shard {
+			moves = append(moves, partitionMove{
+				Partition: p.Partition,
+				FromShard: p.Shard,
+				ToShard:   targetShards[lightest],
+			})
+		}
+	}
+	return moves
+}
+
+func (s *ClickHouse) movePartition(ctx context.Context, shardDB ShardDBProvider, m partitionMove) error {
+	conn, err := shardDB.GetShard(ctx, m.FromShard)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to dial source shard %v", m.FromShard)
+	}
+	zkPath := fmt.Sprintf("/clickhouse/{installation}/{cluster}/tables/%v/default/proxy_stat", m.ToShard)
+	log.Infof("Moving partition %v from shard %v to shard %v", m.Partition, m.FromShard, m.ToShard)
+	return conn.Exec(ctx, fmt.Sprintf("ALTER TABLE proxy_stat MOVE PARTITION %v TO SHARD '%v'", m.Partition, zkPath))
+}
+
+// RebalanceCommand builds the `clickhouse-rebalance` CLI subcommand. The
+// caller supplies newClickHouse so this file doesn't need to know how the
+// rest of the app wires up a DBProvider.
+func RebalanceCommand(newClickHouse func(c *cli.Context) (*ClickHouse, error)) cli.Command {
+	return cli.Command{
+		Name:  "clickhouse-rebalance",
+		Usage: "move proxy_stat partitions across shards via ALTER TABLE ... MOVE PARTITION",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "target-shards",
+				Usage: "desired number of shards",
+			},
+			cli.IntFlag{
+				Name:  "concurrency",
+				Usage: "number of MOVE PARTITION statements to run in parallel",
+				Value: 4,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.Int("target-shards") <= 0 {
+				return errors.New("--target-shards must be set to a positive number")
+			}
+			ch, err := newClickHouse(c)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to build ClickHouse client")
+			}
+			return ch.Rebalance(context.Background(), c.Int("target-shards"), c.Int("concurrency"))
+		},
+	}
+}
@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+func TestPlanRebalanceMovesPerShardPartitionPair(t *testing.T) {
+	parts := []shardPartition{
+		{Shard: "1", Partition: "202601", Rows: 100},
+		{Shard: "2", Partition: "202601", Rows: 100},
+		{Shard: "3", Partition: "202601", Rows: 100},
+		{Shard: "1", Partition: "202602", Rows: 50},
+	}
+
+	moves := planRebalance(parts, 2)
+
+	byPartition := map[string]int{}
+	for _, m := range moves {
+		byPartition[m.Partition]++
+		if m.FromShard == m.ToShard {
+			t.Errorf("Move %+v is a no-op, should not have been emitted", m)
+		}
+	}
+
+	// With 3 equally-sized (shard, partition) rows for 202601 spread across
+	// 3 source shards but only 2 target shards, at least one of them must
+	// move even though they all belong to the same partition - this is the
+	// case that collapsing rows into one move per partition would drop.
+	if byPartition["202601"] == 0 {
+		t.Errorf("Expected at least one move for partition 202601 spread across 3 shards, got moves %+v", moves)
+	}
+}
+
+func TestPlanRebalanceNoOpWhenAlreadyBalanced(t *testing.T) {
+	parts := []shardPartition{
+		{Shard: "1", Partition: "202601", Rows: 100},
+		{Shard: "2", Partition: "202602", Rows: 100},
+	}
+
+	moves := planRebalance(parts, 2)
+	if len(moves) != 0 {
+		t.Errorf("Expected no moves for an already-balanced layout, got %+v", moves)
+	}
+}
+
+// fakeShardConnProvider is a DBProvider that also implements
+// ShardDBProvider, recording which shard each movePartition dispatch
+// actually dialed so the test can assert real per-shard routing instead
+// of a single shared connection.
+type fakeShardConnProvider struct {
+	mux    sync.Mutex
+	dialed []string
+}
+
+func (p *fakeShardConnProvider) Get(ctx context.Context) (clickhouse.Conn, error) {
+	return &fakeShardConn{provider: p}, nil
+}
+
+func (p *fakeShardConnProvider) GetShard(ctx context.Context, shard string) (clickhouse.Conn, error) {
+	p.mux.Lock()
+	p.dialed = append(p.dialed, shard)
+	p.mux.Unlock()
+	return &fakeShardConn{provider: p}, nil
+}
+
+type fakeShardConn struct {
+	clickhouse.Conn
+	provider *fakeShardConnProvider
+}
+
+func (c *fakeShardConn) Exec(ctx context.Context, query string, args ...interface{}) error {
+	return nil
+}
+
+func TestMovePartitionDialsSourceShard(t *testing.T) {
+	provider := &fakeShardConnProvider{}
+	ch := &ClickHouse{}
+
+	m := partitionMove{Partition: "202601", FromShard: "3", ToShard: "1"}
+	if err := ch.movePartition(context.Background(), provider, m); err != nil {
+		t.Fatalf("movePartition returned error: %s", err)
+	}
+
+	if len(provider.dialed) != 1 || provider.dialed[0] != "3" {
+		t.Errorf("Expected movePartition to dial source shard %q, dialed %v", m.FromShard, provider.dialed)
+	}
+}
@@ -1,72 +1,107 @@
 package services
 
 import (
-	"database/sql"
-	"os"
+	"context"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/urfave/cli"
 )
 
-type ClickHouseDB_Mock struct {
-	db *sql.DB
+// fakeConnProvider and friends stand in for the native clickhouse.Conn so
+// the batching logic in ClickHouse can be exercised without a real server.
+type fakeConnProvider struct {
+	mux         sync.Mutex
+	sentBatches []int
+	tracker     *concurrencyTracker
 }
 
-func (s *ClickHouseDB_Mock) Get() (*sql.DB, error) {
-	return s.db, nil
+// concurrencyTracker records how many Send() calls were ever in flight at
+// the same time, so a test can assert that storeWorker goroutines really
+// do run concurrently instead of serializing on a shared lock.
+type concurrencyTracker struct {
+	mux     sync.Mutex
+	current int
+	max     int
+}
+
+func (t *concurrencyTracker) enter() {
+	t.mux.Lock()
+	t.current++
+	if t.current > t.max {
+		t.max = t.current
+	}
+	t.mux.Unlock()
+}
+
+func (t *concurrencyTracker) leave() {
+	t.mux.Lock()
+	t.current--
+	t.mux.Unlock()
+}
+
+func (t *concurrencyTracker) peakConcurrency() int {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.max
+}
+
+func (p *fakeConnProvider) Get(ctx context.Context) (clickhouse.Conn, error) {
+	return &fakeConn{provider: p}, nil
+}
+
+type fakeConn struct {
+	clickhouse.Conn
+	provider *fakeConnProvider
+}
+
+func (c *fakeConn) Exec(ctx context.Context, query string, args ...interface{}) error {
+	return nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error { return nil }
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) PrepareBatch(ctx context.Context, query string, opts ...driver.PrepareBatchOption) (driver.Batch, error) {
+	return &fakeBatch{provider: c.provider}, nil
+}
+
+type fakeBatch struct {
+	driver.Batch
+	provider *fakeConnProvider
+	rows     int
+}
+
+func (b *fakeBatch) Append(v ...interface{}) error {
+	b.rows++
+	return nil
+}
+
+func (b *fakeBatch) Send() error {
+	if b.provider.tracker != nil {
+		b.provider.tracker.enter()
+		time.Sleep(5 * time.Millisecond)
+		defer b.provider.tracker.leave()
+	}
+	b.provider.mux.Lock()
+	b.provider.sentBatches = append(b.provider.sentBatches, b.rows)
+	b.provider.mux.Unlock()
+	return nil
 }
 
 func TestClickHouse(t *testing.T) {
 	app := cli.NewApp()
 	RegisterClickHouseFlags(app)
 	app.Action = func(c *cli.Context) error {
-		db, mock, err := sqlmock.New()
-		if err != nil {
-			return nil
-		}
-		r := &StatRecord{}
-		mock.ExpectExec("CREATE TABLE IF NOT EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
-		mock.ExpectBegin()
-		stmt := mock.ExpectPrepare("INSERT INTO")
-		for i := 0; i < 1000; i++ {
-			stmt.ExpectExec().WithArgs(r.Timestamp, r.ApiKey, r.Client, r.BytesWritten, r.TTFB,
-				r.Duration, r.Path, r.InfoHash, r.OriginalPath, r.SessionID,
-				r.Domain, r.Status, r.GroupedStatus, r.Edge, r.Source,
-				r.Role, 0,
-			).WillReturnResult(sqlmock.NewResult(1, 1))
-		}
-		mock.ExpectCommit()
-		mock.ExpectBegin()
-		stmt = mock.ExpectPrepare("INSERT INTO")
-		for i := 0; i < 1000; i++ {
-			stmt.ExpectExec().WithArgs(r.Timestamp, r.ApiKey, r.Client, r.BytesWritten, r.TTFB,
-				r.Duration, r.Path, r.InfoHash, r.OriginalPath, r.SessionID,
-				r.Domain, r.Status, r.GroupedStatus, r.Edge, r.Source,
-				r.Role, 0,
-			).WillReturnResult(sqlmock.NewResult(1, 1))
-		}
-		mock.ExpectCommit()
-		mock.ExpectBegin()
-		stmt = mock.ExpectPrepare("INSERT INTO")
-		for i := 0; i < 100; i++ {
-			stmt.ExpectExec().WithArgs(r.Timestamp, r.ApiKey, r.Client, r.BytesWritten, r.TTFB,
-				r.Duration, r.Path, r.InfoHash, r.OriginalPath, r.SessionID,
-				r.Domain, r.Status, r.GroupedStatus, r.Edge, r.Source,
-				r.Role, 0,
-			).WillReturnResult(sqlmock.NewResult(1, 1))
-		}
-		mock.ExpectCommit()
-
-		clickHouseDB := &ClickHouseDB_Mock{
-			db: db,
-		}
-
-		clickHouse := NewClickHouse(c, clickHouseDB)
+		provider := &fakeConnProvider{}
+		clickHouse := NewClickHouse(c, provider)
 
 		for i := 0; i < 2100; i++ {
-			if err = clickHouse.Add(&StatRecord{}); err != nil {
+			if err := clickHouse.Add(&StatRecord{}); err != nil {
 				t.Errorf("Error while adding stats: %s", err)
 			}
 		}
@@ -76,18 +111,156 @@ func TestClickHouse(t *testing.T) {
 			t.Errorf("Expected batch size %v got %v", 100, len(clickHouse.batch))
 		}
 
-		clickHouse.Close()
+		if err := clickHouse.Close(); err != nil {
+			t.Errorf("Error while closing: %s", err)
+		}
 
 		if len(clickHouse.batch) != 0 {
 			t.Errorf("Expected empty batch but %v records still reamins", len(clickHouse.batch))
 		}
 
-		if err := mock.ExpectationsWereMet(); err != nil {
-			t.Errorf("There were unfulfilled expectations: %s", err)
+		expected := []int{1000, 1000, 100}
+		if len(provider.sentBatches) != len(expected) {
+			t.Fatalf("Expected batches %v, got %v", expected, provider.sentBatches)
+		}
+		for i, want := range expected {
+			if provider.sentBatches[i] != want {
+				t.Errorf("Expected batch %v to have %v rows got %v", i, want, provider.sentBatches[i])
+			}
+		}
+
+		return nil
+	}
+	// Pin a single worker so batches are stored in the order they were
+	// enqueued, which is what the assertions above rely on.
+	app.Run([]string{"test", "--clickhouse-workers", "1"})
+}
+
+// TestClickHouseConcurrentAdd exercises the bounded-channel handoff in Add
+// with many concurrent producers under `go test -race` to guard against
+// the batch-swap race: every producer's record must be accounted for in
+// exactly one stored batch, never duplicated or lost.
+func TestClickHouseConcurrentAdd(t *testing.T) {
+	app := cli.NewApp()
+	RegisterClickHouseFlags(app)
+	app.Action = func(c *cli.Context) error {
+		provider := &fakeConnProvider{}
+		clickHouse := NewClickHouse(c, provider)
+
+		const producers = 1000
+		var wg sync.WaitGroup
+		wg.Add(producers)
+		for i := 0; i < producers; i++ {
+			go func() {
+				defer wg.Done()
+				if err := clickHouse.Add(&StatRecord{}); err != nil {
+					t.Errorf("Error while adding stats: %s", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if err := clickHouse.Close(); err != nil {
+			t.Errorf("Error while closing: %s", err)
+		}
+
+		provider.mux.Lock()
+		total := 0
+		for _, rows := range provider.sentBatches {
+			total += rows
+		}
+		provider.mux.Unlock()
+
+		if total != producers {
+			t.Errorf("Expected %v rows stored across all batches, got %v", producers, total)
+		}
+
+		return nil
+	}
+	app.Run([]string{
+		"test",
+		"--clickhouse-batch-size", "37",
+		"--clickhouse-workers", "4",
+		"--clickhouse-max-in-flight", "8",
+	})
+}
+
+// TestClickHouseCloseWhileAddInFlight overlaps a producer hammering Add
+// with a concurrent Close, unlike TestClickHouseConcurrentAdd which fully
+// wg.Wait()s its producers before closing. Without closeMux guarding the
+// send in enqueue, this reliably panics with "send on closed channel" (and
+// trips -race) as soon as Close closes s.batches while Add is still
+// sending on it.
+func TestClickHouseCloseWhileAddInFlight(t *testing.T) {
+	app := cli.NewApp()
+	RegisterClickHouseFlags(app)
+	app.Action = func(c *cli.Context) error {
+		provider := &fakeConnProvider{}
+		clickHouse := NewClickHouse(c, provider)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("Add panicked while racing Close: %v", r)
+				}
+			}()
+			for i := 0; i < 10000; i++ {
+				if err := clickHouse.Add(&StatRecord{}); err != nil {
+					t.Errorf("Error while adding stats: %s", err)
+				}
+			}
+		}()
+
+		if err := clickHouse.Close(); err != nil {
+			t.Errorf("Error while closing: %s", err)
+		}
+		wg.Wait()
+
+		return nil
+	}
+	app.Run([]string{
+		"test",
+		"--clickhouse-batch-size", "1",
+		"--clickhouse-workers", "2",
+		"--clickhouse-max-in-flight", "2",
+	})
+}
+
+// TestClickHouseStoresBatchesConcurrently guards against store() taking a
+// lock around its whole body: with CLICKHOUSE_WORKERS > 1 and several full
+// batches queued up, more than one batch must be in Send() at once.
+func TestClickHouseStoresBatchesConcurrently(t *testing.T) {
+	app := cli.NewApp()
+	RegisterClickHouseFlags(app)
+	app.Action = func(c *cli.Context) error {
+		tracker := &concurrencyTracker{}
+		provider := &fakeConnProvider{tracker: tracker}
+		clickHouse := NewClickHouse(c, provider)
+
+		const batchSize = 37
+		for i := 0; i < batchSize*8; i++ {
+			if err := clickHouse.Add(&StatRecord{}); err != nil {
+				t.Errorf("Error while adding stats: %s", err)
+			}
+		}
+
+		if err := clickHouse.Close(); err != nil {
+			t.Errorf("Error while closing: %s", err)
+		}
+
+		if max := tracker.peakConcurrency(); max < 2 {
+			t.Errorf("Expected at least 2 concurrent store() calls with multiple workers, got %v", max)
 		}
 
 		return nil
 	}
-	args := os.Args[0:1]
-	app.Run(args)
+	app.Run([]string{
+		"test",
+		"--clickhouse-batch-size", "37",
+		"--clickhouse-workers", "4",
+		"--clickhouse-max-in-flight", "16",
+	})
 }
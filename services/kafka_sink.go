@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/urfave/cli"
+)
+
+const (
+	KAFKA_BROKERS = "kafka-brokers"
+	KAFKA_TOPIC   = "kafka-topic"
+)
+
+func RegisterKafkaFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringSliceFlag{
+		Name:   KAFKA_BROKERS,
+		Usage:  "kafka broker addresses",
+		EnvVar: "KAFKA_BROKERS",
+	})
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   KAFKA_TOPIC,
+		Usage:  "kafka topic StatRecords are produced to",
+		Value:  "proxy_stat",
+		EnvVar: "KAFKA_TOPIC",
+	})
+}
+
+// KafkaSink implements StatSink by producing each StatRecord as JSON to a
+// Kafka topic, keyed by SessionID so records for a given session land on
+// the same partition.
+type KafkaSink struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaSink(c *cli.Context) *KafkaSink {
+	return &KafkaSink{
+		writer: &kafka.Writer{
+			Addr:     kafka.TCP(c.StringSlice(KAFKA_BROKERS)...),
+			Topic:    c.String(KAFKA_TOPIC),
+			Balancer: &kafka.Hash{},
+		},
+	}
+}
+
+func (k *KafkaSink) Add(sr *StatRecord) error {
+	msg, err := kafkaMessage(sr)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to marshal StatRecord")
+	}
+	if err := k.writer.WriteMessages(context.Background(), msg); err != nil {
+		return errors.Wrapf(err, "Failed to produce StatRecord to Kafka")
+	}
+	return nil
+}
+
+// kafkaMessage builds the Kafka message for a StatRecord, keyed by
+// SessionID so records for a given session land on the same partition.
+func kafkaMessage(sr *StatRecord) (kafka.Message, error) {
+	value, err := json.Marshal(sr)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{
+		Key:   []byte(sr.SessionID),
+		Value: value,
+	}, nil
+}
+
+func (k *KafkaSink) Close() error {
+	return k.writer.Close()
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"context"
+
+	otellog "go.opentelemetry.io/otel/log"
+	"go.opentelemetry.io/otel/log/global"
+)
+
+// OTLPSink implements StatSink by emitting each StatRecord as an
+// OpenTelemetry log record with attributes mapped from the struct
+// fields, so it can fan out to whatever collector the operator already
+// points at ClickHouse, Loki, or any other OTLP-speaking store.
+type OTLPSink struct {
+	logger otellog.Logger
+}
+
+func NewOTLPSink() *OTLPSink {
+	return &OTLPSink{logger: global.Logger("torrent-http-proxy/stats")}
+}
+
+func (o *OTLPSink) Add(sr *StatRecord) error {
+	var rec otellog.Record
+	rec.SetTimestamp(sr.Timestamp)
+	rec.SetBody(otellog.StringValue("proxy_stat"))
+	rec.AddAttributes(
+		otellog.String("api_key", sr.ApiKey),
+		otellog.String("client", sr.Client),
+		otellog.Int64("bytes_written", int64(sr.BytesWritten)),
+		otellog.Int64("ttfb", int64(sr.TTFB)),
+		otellog.Int64("duration", int64(sr.Duration)),
+		otellog.String("path", sr.Path),
+		otellog.String("info_hash", sr.InfoHash),
+		otellog.String("original_path", sr.OriginalPath),
+		otellog.String("session_id", sr.SessionID),
+		otellog.String("domain", sr.Domain),
+		otellog.Int64("status", int64(sr.Status)),
+		otellog.Int64("grouped_status", int64(sr.GroupedStatus)),
+		otellog.String("edge", sr.Edge),
+		otellog.String("source", sr.Source),
+		otellog.String("role", sr.Role),
+		otellog.Bool("ads", sr.Ads),
+	)
+	o.logger.Emit(context.Background(), rec)
+	return nil
+}
+
+func (o *OTLPSink) Close() error {
+	return nil
+}
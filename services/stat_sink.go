@@ -0,0 +1,80 @@
+package services
+
+import (
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const STAT_SINK = "stat-sink"
+
+func RegisterStatSinkFlags(c *cli.App) {
+	c.Flags = append(c.Flags, cli.StringFlag{
+		Name:   STAT_SINK,
+		Usage:  "stat sink to write StatRecords to (clickhouse, kafka, otlp or multi)",
+		Value:  "clickhouse",
+		EnvVar: "STAT_SINK",
+	})
+}
+
+// StatSink is the extension point for anything that can durably record a
+// StatRecord. ClickHouse, KafkaSink and OTLPSink all implement it, and
+// MultiSink composes several of them so operators can dual-write during a
+// migration between backends.
+type StatSink interface {
+	Add(*StatRecord) error
+	Close() error
+}
+
+// NewStatSink builds the StatSink selected by the --stat-sink flag.
+// newClickHouse is only invoked for the "clickhouse" and "multi" sinks,
+// since NewClickHouse starts background storeWorker/flushLoop goroutines as
+// a side effect of construction - calling it up front for every sink
+// selection would leak those goroutines whenever kafka or otlp is chosen.
+func NewStatSink(c *cli.Context, newClickHouse func(c *cli.Context) (*ClickHouse, error)) (StatSink, error) {
+	switch c.String(STAT_SINK) {
+	case "", "clickhouse":
+		return newClickHouse(c)
+	case "kafka":
+		return NewKafkaSink(c), nil
+	case "otlp":
+		return NewOTLPSink(), nil
+	case "multi":
+		ch, err := newClickHouse(c)
+		if err != nil {
+			return nil, err
+		}
+		return NewMultiSink(ch, NewKafkaSink(c), NewOTLPSink()), nil
+	default:
+		return nil, errors.Errorf("Unknown stat sink %q", c.String(STAT_SINK))
+	}
+}
+
+// MultiSink fans a StatRecord out to several StatSinks, e.g. to dual-write
+// to ClickHouse and Kafka while migrating between backends.
+type MultiSink struct {
+	sinks []StatSink
+}
+
+func NewMultiSink(sinks ...StatSink) *MultiSink {
+	return &MultiSink{sinks: sinks}
+}
+
+func (m *MultiSink) Add(sr *StatRecord) error {
+	var firstErr error
+	for _, sink := range m.sinks {
+		if err := sink.Add(sr); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "Failed to add to sink")
+		}
+	}
+	return firstErr
+}
+
+func (m *MultiSink) Close() error {
+	var firstErr error
+	for _, sink := range m.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "Failed to close sink")
+		}
+	}
+	return firstErr
+}
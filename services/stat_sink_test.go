@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	otellog "go.opentelemetry.io/otel/log"
+)
+
+func TestKafkaMessageKeyedBySessionID(t *testing.T) {
+	sr := &StatRecord{SessionID: "abc123", ApiKey: "key"}
+
+	msg, err := kafkaMessage(sr)
+	if err != nil {
+		t.Fatalf("kafkaMessage returned error: %s", err)
+	}
+
+	if string(msg.Key) != sr.SessionID {
+		t.Errorf("Expected message key %q, got %q", sr.SessionID, msg.Key)
+	}
+
+	var decoded StatRecord
+	if err := json.Unmarshal(msg.Value, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal message value: %s", err)
+	}
+	if decoded.ApiKey != sr.ApiKey {
+		t.Errorf("Expected decoded ApiKey %q, got %q", sr.ApiKey, decoded.ApiKey)
+	}
+}
+
+// fakeOtelLogger embeds the real interface so only Emit needs overriding,
+// matching the embedding pattern used for the fake ClickHouse connection
+// in clickhouse_test.go.
+type fakeOtelLogger struct {
+	otellog.Logger
+	records []otellog.Record
+}
+
+func (l *fakeOtelLogger) Emit(ctx context.Context, record otellog.Record) {
+	l.records = append(l.records, record)
+}
+
+func TestOTLPSinkAddEmitsRecord(t *testing.T) {
+	logger := &fakeOtelLogger{}
+	sink := &OTLPSink{logger: logger}
+
+	if err := sink.Add(&StatRecord{SessionID: "abc123"}); err != nil {
+		t.Fatalf("Add returned error: %s", err)
+	}
+
+	if len(logger.records) != 1 {
+		t.Fatalf("Expected 1 emitted record, got %v", len(logger.records))
+	}
+}
+
+type fakeSink struct {
+	added    []*StatRecord
+	closed   bool
+	addErr   error
+	closeErr error
+}
+
+func (s *fakeSink) Add(sr *StatRecord) error {
+	s.added = append(s.added, sr)
+	return s.addErr
+}
+
+func (s *fakeSink) Close() error {
+	s.closed = true
+	return s.closeErr
+}
+
+func TestMultiSinkAddFansOutToAllSinks(t *testing.T) {
+	a := &fakeSink{}
+	b := &fakeSink{}
+	multi := NewMultiSink(a, b)
+
+	sr := &StatRecord{SessionID: "abc123"}
+	if err := multi.Add(sr); err != nil {
+		t.Fatalf("Add returned error: %s", err)
+	}
+
+	if len(a.added) != 1 || len(b.added) != 1 {
+		t.Errorf("Expected both sinks to receive the record, got a=%v b=%v", len(a.added), len(b.added))
+	}
+}
+
+func TestMultiSinkAddSurfacesFirstError(t *testing.T) {
+	wantErr := errors.New("boom")
+	a := &fakeSink{addErr: wantErr}
+	b := &fakeSink{}
+	multi := NewMultiSink(a, b)
+
+	err := multi.Add(&StatRecord{})
+	if err == nil || errors.Cause(err) != wantErr {
+		t.Errorf("Expected error wrapping %v, got %v", wantErr, err)
+	}
+
+	if len(b.added) != 1 {
+		t.Errorf("Expected second sink to still receive the record despite the first erroring, got %v", len(b.added))
+	}
+}
+
+func TestMultiSinkCloseClosesAllSinks(t *testing.T) {
+	a := &fakeSink{}
+	b := &fakeSink{}
+	multi := NewMultiSink(a, b)
+
+	if err := multi.Close(); err != nil {
+		t.Fatalf("Close returned error: %s", err)
+	}
+
+	if !a.closed || !b.closed {
+		t.Errorf("Expected both sinks to be closed, got a=%v b=%v", a.closed, b.closed)
+	}
+}